@@ -0,0 +1,160 @@
+package filecache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// InvalidCacheDir is returned by the content-addressed Put/Get methods when
+// FileCache.Dir has not been set.
+var InvalidCacheDir = errors.New("filecache: Dir must be set for content-addressed storage")
+
+// Entry describes a stored content-addressed cache entry.
+type Entry struct {
+	OutputID [32]byte
+	Size     int64
+	Time     time.Time
+}
+
+// EntryNotFoundError is returned by Get and GetFile when key is not present
+// in the content-addressed store, or its contents fail integrity
+// verification against the recorded OutputID.
+type EntryNotFoundError struct {
+	Key [32]byte
+}
+
+func (e *EntryNotFoundError) Error() string {
+	return fmt.Sprintf("filecache: entry not found for key %x", e.Key)
+}
+
+// casPath returns the sharded path for a 32 byte key under cache.Dir, e.g.
+// Dir/aa/aabbcc...<suffix>.
+func (cache *FileCache) casPath(key [32]byte, suffix string) string {
+	hexKey := hex.EncodeToString(key[:])
+	return filepath.Join(cache.Dir, hexKey[:2], hexKey+suffix)
+}
+
+// writeAtomic writes data to path by writing to a temporary file in the
+// same directory and renaming it into place, so concurrent readers never
+// observe a partially written file.
+func writeAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "filecache-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// PutBytes stores data under key, recording its SHA-256 as the entry's
+// OutputID.
+func (cache *FileCache) PutBytes(key [32]byte, data []byte) error {
+	_, err := cache.PutReader(key, bytes.NewReader(data))
+	return err
+}
+
+// PutReader stores the contents of r under key, recording its SHA-256 as
+// the entry's OutputID, and returns the number of bytes written.
+func (cache *FileCache) PutReader(key [32]byte, r io.Reader) (size int64, err error) {
+	if cache.Dir == "" {
+		return 0, InvalidCacheDir
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+	size = int64(len(data))
+
+	if err = writeAtomic(cache.casPath(key, "-d"), data); err != nil {
+		return
+	}
+
+	outputID := sha256.Sum256(data)
+	entry := Entry{OutputID: outputID, Size: size, Time: time.Now()}
+	err = cache.writeEntry(key, entry)
+	return
+}
+
+// Get returns the Entry stored under key, verifying its data file against
+// the recorded OutputID. It returns an *EntryNotFoundError if key is
+// absent or fails verification.
+func (cache *FileCache) Get(key [32]byte) (Entry, error) {
+	if cache.Dir == "" {
+		return Entry{}, InvalidCacheDir
+	}
+
+	entry, err := cache.readEntry(key)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	data, err := ioutil.ReadFile(cache.casPath(key, "-d"))
+	if err != nil {
+		return Entry{}, &EntryNotFoundError{Key: key}
+	}
+	if sha256.Sum256(data) != entry.OutputID {
+		return Entry{}, &EntryNotFoundError{Key: key}
+	}
+	return entry, nil
+}
+
+// GetFile is like Get, but returns the path to the stable on-disk file
+// holding the entry's content instead of reading it into memory.
+func (cache *FileCache) GetFile(key [32]byte) (string, Entry, error) {
+	entry, err := cache.Get(key)
+	if err != nil {
+		return "", Entry{}, err
+	}
+	return cache.casPath(key, "-d"), entry, nil
+}
+
+// writeEntry records entry's index line under key, alongside its data
+// file.
+func (cache *FileCache) writeEntry(key [32]byte, entry Entry) error {
+	line := fmt.Sprintf("%x %d %d\n", entry.OutputID, entry.Size, entry.Time.UnixNano())
+	return writeAtomic(cache.casPath(key, "-a"), []byte(line))
+}
+
+// readEntry loads the index entry stored under key.
+func (cache *FileCache) readEntry(key [32]byte) (Entry, error) {
+	raw, err := ioutil.ReadFile(cache.casPath(key, "-a"))
+	if err != nil {
+		return Entry{}, &EntryNotFoundError{Key: key}
+	}
+
+	var outputIDHex string
+	var entry Entry
+	var unixNano int64
+	if _, err := fmt.Sscanf(string(raw), "%s %d %d", &outputIDHex, &entry.Size, &unixNano); err != nil {
+		return Entry{}, &EntryNotFoundError{Key: key}
+	}
+
+	outputID, err := hex.DecodeString(outputIDHex)
+	if err != nil || len(outputID) != 32 {
+		return Entry{}, &EntryNotFoundError{Key: key}
+	}
+	copy(entry.OutputID[:], outputID)
+	entry.Time = time.Unix(0, unixNano)
+	return entry, nil
+}
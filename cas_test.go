@@ -0,0 +1,96 @@
+package filecache
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPutBytesGetRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filecache-cas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := NewCache()
+	cache.Dir = dir
+
+	key := sha256.Sum256([]byte("round-trip-key"))
+	data := []byte("the quick brown fox jumps over the lazy dog")
+
+	if err := cache.PutBytes(key, data); err != nil {
+		t.Fatalf("PutBytes: %v", err)
+	}
+
+	entry, err := cache.Get(key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if entry.Size != int64(len(data)) {
+		t.Fatalf("entry.Size = %d, want %d", entry.Size, len(data))
+	}
+	if entry.OutputID != sha256.Sum256(data) {
+		t.Fatalf("entry.OutputID does not match sha256 of stored data")
+	}
+
+	path, fileEntry, err := cache.GetFile(key)
+	if err != nil {
+		t.Fatalf("GetFile: %v", err)
+	}
+	if fileEntry.OutputID != entry.OutputID {
+		t.Fatalf("GetFile entry.OutputID = %x, want %x", fileEntry.OutputID, entry.OutputID)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading GetFile path: %v", err)
+	}
+	if string(got) != string(data) {
+		t.Fatalf("GetFile content = %q, want %q", got, data)
+	}
+}
+
+func TestGetDetectsTamperedData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filecache-cas-tamper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := NewCache()
+	cache.Dir = dir
+
+	key := sha256.Sum256([]byte("tamper-key"))
+	data := []byte("original content")
+	if err := cache.PutBytes(key, data); err != nil {
+		t.Fatalf("PutBytes: %v", err)
+	}
+
+	dataPath := cache.casPath(key, "-d")
+	if err := ioutil.WriteFile(dataPath, []byte("corrupted content"), 0644); err != nil {
+		t.Fatalf("corrupting data file: %v", err)
+	}
+
+	_, err = cache.Get(key)
+	if _, ok := err.(*EntryNotFoundError); !ok {
+		t.Fatalf("Get on tampered data returned %v (%T), want *EntryNotFoundError", err, err)
+	}
+}
+
+func TestGetMissingKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filecache-cas-missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := NewCache()
+	cache.Dir = dir
+
+	key := sha256.Sum256([]byte("never-stored"))
+	_, err = cache.Get(key)
+	if _, ok := err.(*EntryNotFoundError); !ok {
+		t.Fatalf("Get on missing key returned %v (%T), want *EntryNotFoundError", err, err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -31,6 +32,7 @@ var (
 	ItemNotInCache   = errors.New("item not in cache")
 	ItemTooLarge     = errors.New("item too large for cache")
 	WriteIncomplete  = errors.New("incomplete write of cache item")
+	CacheStopped     = errors.New("cache is not active")
 )
 
 // Mumber of items to buffer adding to the file cache.
@@ -40,12 +42,26 @@ var NewCachePipeSize = 4
 // An ExpireItem value of 0 means that items should not be expired based
 // on time in memory.
 type FileCache struct {
-	items      map[string]*cacheItem
-	in_pipe    chan string
+	mu      sync.RWMutex
+	items   map[string]*cacheItem
+	in_pipe chan string
+	done    chan struct{}
+
+	sfMu    sync.Mutex
+	sfCalls map[string]*sfCall
+
 	MaxItems   int   // Maximum number of files to cache
 	MaxSize    int64 // Maximum file size to store
 	ExpireItem int   // Seconds a file should be cached for
 	Every      int   // Run an expiration check Every seconds
+
+	Mode      CacheMode // CacheModeFull (default) or CacheModePartial
+	SparseDir string    // directory for sparse backing files; required for CacheModePartial
+
+	Dir        string // base directory for on-disk cache storage; required by PutBytes, PutReader, Get and Persistent
+	Persistent bool   // if true, Start() rehydrates items from an index under Dir, and add_item persists them back
+
+	Policy EvictionPolicy // decides which item to evict; nil disables policy-driven eviction and falls back to the original oldest-access scan
 }
 
 // CacheItem represents an item in the cache
@@ -54,6 +70,23 @@ type cacheItem struct {
 	Size       int64
 	Lastaccess time.Time
 	Modified   time.Time
+
+	// sparse, ranges and closed are only set for items cached under
+	// CacheModePartial; see partial.go. mu guards the item's fields in
+	// every mode. closed is set once the item's
+	// sparse file has been closed by closeSparseItem, so a goroutine
+	// already holding this cacheItem when it's evicted can detect the
+	// eviction instead of reading or writing a closed file.
+	sparse *os.File
+	ranges *rangeSet
+	closed bool
+	mu     sync.RWMutex
+
+	// blobPath and sha256 are set once the item has been persisted to
+	// disk under FileCache.Dir; see persist.go. Content may be nil for a
+	// rehydrated item until loadContent reads it from blobPath.
+	blobPath string
+	sha256   string
 }
 
 // NewCache returns an initialised (barely) cache.
@@ -72,11 +105,14 @@ func NewDefaultCache() *FileCache {
 	cache.MaxSize = DefaultMaxSize
 	cache.ExpireItem = DefaultExpireItem
 	cache.Every = DefaultEvery
+	cache.Policy = NewLRUPolicy()
 	return cache
 }
 
 // Active returns true if the cache has been started, and false otherwise.
 func (cache *FileCache) Active() bool {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
 	if cache.in_pipe == nil || cache.items == nil {
 		return false
 	}
@@ -85,11 +121,15 @@ func (cache *FileCache) Active() bool {
 
 // Size returns the number of entries in the cache.
 func (cache *FileCache) Size() int {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
 	return len(cache.items)
 }
 
 // FileSize returns the sum of the file sizes stored in the cache
 func (cache *FileCache) FileSize() (totalSize int64) {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
 	for _, itm := range cache.items {
 		totalSize += itm.Size
 	}
@@ -98,6 +138,8 @@ func (cache *FileCache) FileSize() (totalSize int64) {
 
 // StoredFiles returns the list of files stored in the cache.
 func (cache *FileCache) StoredFiles() (fileList []string) {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
 	fileList = make([]string, 0)
 	for name, _ := range cache.items {
 		fileList = append(fileList, name)
@@ -107,7 +149,7 @@ func (cache *FileCache) StoredFiles() (fileList []string) {
 
 // FileChanged returns true if file should be expired based on mtime.
 // If the file has changed on disk or no longer exists, it should be
-// expired.
+// expired. The caller must hold cache.mu.
 func (cache *FileCache) changed(name string) bool {
 	itm, ok := cache.items[name]
 	if !ok {
@@ -116,19 +158,24 @@ func (cache *FileCache) changed(name string) bool {
 	fi, err := os.Stat(name)
 	if err != nil {
 		return true
-	} else if !itm.Modified.Equal(fi.ModTime()) {
-		return true
 	}
-	return false
+	itm.mu.RLock()
+	modified := itm.Modified
+	itm.mu.RUnlock()
+	return !modified.Equal(fi.ModTime())
 }
 
-// Expired returns true if the item has not been accessed recently.
+// Expired returns true if the item has not been accessed recently. The
+// caller must hold cache.mu.
 func (cache *FileCache) expired(name string) bool {
 	itm, ok := cache.items[name]
 	if !ok {
 		return true
 	}
-	dur := time.Now().Sub(itm.Lastaccess)
+	itm.mu.RLock()
+	lastaccess := itm.Lastaccess
+	itm.mu.RUnlock()
+	dur := time.Now().Sub(lastaccess)
 	sec, err := strconv.Atoi(fmt.Sprintf("%0.0f", dur.Seconds()))
 	if err != nil {
 		return true
@@ -138,7 +185,8 @@ func (cache *FileCache) expired(name string) bool {
 	return false
 }
 
-// item_expired returns true if an item is expired.
+// item_expired returns true if an item is expired. The caller must hold
+// cache.mu.
 func (cache *FileCache) item_expired(name string) bool {
 	if cache.changed(name) {
 		return true
@@ -150,18 +198,29 @@ func (cache *FileCache) item_expired(name string) bool {
 
 // InCache returns true if the item is in the cache.
 func (cache *FileCache) InCache(name string) bool {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
 	_, ok := cache.items[name]
 	return ok
 }
 
 // WriteItem writes the cache item to the specified io.Writer.
 func (cache *FileCache) WriteItem(w io.Writer, name string) (err error) {
+	cache.mu.RLock()
 	itm, ok := cache.items[name]
+	cache.mu.RUnlock()
+	if cache.Policy != nil {
+		cache.Policy.OnAccess(name)
+	}
 	if !ok {
 		err = ItemNotInCache
 		return
 	}
-	n, err := fmt.Fprintf(w, "%s", itm.Content)
+	content, err := loadContent(itm)
+	if err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(w, "%s", content)
 	if err != nil {
 		return
 	} else if int64(n) != itm.Size {
@@ -175,38 +234,59 @@ func (cache *FileCache) WriteItem(w io.Writer, name string) (err error) {
 // GetItem should be used when you are certain an object is in the cache,
 // or if you want to use the cache only.
 func (cache *FileCache) GetItem(name string) (content []byte, ok bool) {
+	cache.mu.RLock()
 	itm, ok := cache.items[name]
+	cache.mu.RUnlock()
+	if cache.Policy != nil {
+		cache.Policy.OnAccess(name)
+	}
 	if !ok {
 		return
 	}
-	content = itm.Content
+	content, err := loadContent(itm)
+	if err != nil {
+		ok = false
+		return
+	}
 	return
 }
 
 // GetItemString is the same as GetItem, except returning a string.
 func (cache *FileCache) GetItemString(name string) (content string, ok bool) {
+	cache.mu.RLock()
 	itm, ok := cache.items[name]
+	cache.mu.RUnlock()
+	if cache.Policy != nil {
+		cache.Policy.OnAccess(name)
+	}
 	if !ok {
 		return
 	}
-	content = string(itm.Content)
+	raw, err := loadContent(itm)
+	if err != nil {
+		ok = false
+		return
+	}
+	content = string(raw)
 	return
 }
 
 // ReadFile retrieves the file named by 'name'.
-// If the file is not in the cache, load the file and cache the file in the 
-// background. If the file was not in the cache and the read was successful,
+// If the file is not in the cache, it is read from the filesystem and
+// cached for next time, coalescing with any identical read already in
+// flight. If the file was not in the cache and the read was successful,
 // the error ItemNotInCache is returned to indicate that the item was pulled
 // from the filesystem and not the cache.
 func (cache *FileCache) ReadFile(name string) (content []byte, err error) {
 	if cache.InCache(name) {
 		content, _ = cache.GetItem(name)
-	} else {
-		go cache.Cache(name)
-		content, err = ioutil.ReadFile(name)
-		if err == nil {
-			err = ItemNotInCache
-		}
+		return
+	}
+	content, err = cache.singleflight(name, func() ([]byte, error) {
+		return cache.fetch_and_cache(name)
+	})
+	if err == nil {
+		err = ItemNotInCache
 	}
 	return
 }
@@ -215,51 +295,49 @@ func (cache *FileCache) ReadFile(name string) (content []byte, err error) {
 func (cache *FileCache) ReadFileString(name string) (content string, err error) {
 	if cache.InCache(name) {
 		content, _ = cache.GetItemString(name)
-	} else {
-		go cache.Cache(name)
-		raw, err := ioutil.ReadFile(name)
-		if err == nil {
-			err = ItemNotInCache
-			content = string(raw)
-		}
+		return
+	}
+	raw, err := cache.singleflight(name, func() ([]byte, error) {
+		return cache.fetch_and_cache(name)
+	})
+	if err == nil {
+		err = ItemNotInCache
+		content = string(raw)
 	}
 	return
 }
 
 // WriteFile writes the file named by 'name' to the specified io.Writer.
 // If the file is in the cache, it is loaded from the cache; otherwise,
-// it is read from the filesystem and the file is cached in the background.
+// it is read from the filesystem (coalescing with any identical read
+// already in flight) and the file is cached for next time.
 func (cache *FileCache) WriteFile(w io.Writer, name string) (err error) {
 	if cache.InCache(name) {
-		err = cache.WriteItem(w, name)
-	} else {
-		var fi os.FileInfo
-		fi, err = os.Stat(name)
-		if err != nil {
-			return
-		} else if fi.IsDir() {
-			return ItemIsDirectory
-		}
-		go cache.Cache(name)
-		var file *os.File
-		file, err = os.Open(name)
-		if err != nil {
-			return
-		}
-		defer file.Close()
-		_, err = io.Copy(w, file)
+		return cache.WriteItem(w, name)
 	}
+	content, err := cache.singleflight(name, func() ([]byte, error) {
+		return cache.fetch_and_cache(name)
+	})
+	if err != nil {
+		return
+	}
+	_, err = w.Write(content)
 	return
 }
 
-// add_item is an internal function for adding an item to the cache.
+// add_item is an internal function for adding an item to the cache. The
+// caller must hold cache.mu.
 func (cache *FileCache) add_item(name string) (err error) {
-	ok := cache.InCache(name)
+	if cache.Mode == CacheModePartial {
+		return cache.add_partial_item(name)
+	}
+
+	_, ok := cache.items[name]
 	expired := cache.item_expired(name)
 	if ok && !expired {
 		return nil
 	} else if ok {
-		delete(cache.items, name)
+		cache.remove_item(name)
 	}
 
 	fi, err := os.Stat(name)
@@ -276,65 +354,186 @@ func (cache *FileCache) add_item(name string) (err error) {
 		return
 	}
 
+	return cache.store_item(name, content, fi)
+}
+
+// store_item creates a cacheItem for name from already-read content and
+// fi, inserts it into cache.items, and runs the Policy and persistence
+// hooks that normally follow a cache insert. The caller must hold
+// cache.mu.
+func (cache *FileCache) store_item(name string, content []byte, fi os.FileInfo) (err error) {
 	itm := new(cacheItem)
 	itm.Content = content
 	itm.Size = fi.Size()
 	itm.Modified = fi.ModTime()
 	itm.Lastaccess = time.Now()
 	cache.items[name] = itm
-	if !cache.InCache(name) {
+	if _, ok := cache.items[name]; !ok {
 		return ItemNotInCache
 	}
+	if cache.Policy != nil {
+		cache.Policy.OnAdd(name, itm.Size)
+	}
+	if cache.Persistent && cache.Dir != "" {
+		if err = cache.persist_item(name, itm); err != nil {
+			return
+		}
+	}
 	return nil
 }
 
-// item_listener is a goroutine that listens for incoming files and caches
-// them.
-func (cache *FileCache) item_listener() {
+// remove_item deletes name from cache.items, cleaning up any sparse
+// backing file and persisted blob the item owns, and notifying the active
+// Policy. This is the path for a real eviction, expiry, or explicit
+// Remove, where the item's on-disk record should no longer exist. The
+// caller must hold cache.mu.
+func (cache *FileCache) remove_item(name string) {
+	itm, ok := cache.items[name]
+	if !ok {
+		return
+	}
+	cache.detach_item(name, itm)
+	if itm.blobPath != "" && !cache.blob_in_use(itm.blobPath) {
+		os.Remove(itm.blobPath)
+	}
+	if cache.Persistent && cache.Dir != "" {
+		cache.saveIndex()
+	}
+}
+
+// blob_in_use reports whether any remaining cached item still points at
+// path. Blob paths are content-addressed, so two different names whose
+// content happens to be identical share one blob file; evicting one must
+// not delete it out from under the other. The caller must hold cache.mu.
+func (cache *FileCache) blob_in_use(path string) bool {
+	for _, itm := range cache.items {
+		if itm.blobPath == path {
+			return true
+		}
+	}
+	return false
+}
+
+// detach_item deletes name from cache.items and closes its sparse backing
+// file, notifying the active Policy, but leaves any persisted blob and
+// index entry untouched. It's the counterpart used by Stop() to tear down
+// the in-memory cache: a Persistent cache's on-disk state must survive so
+// it can be rehydrated by the next Start(). The caller must hold cache.mu.
+func (cache *FileCache) detach_item(name string, itm *cacheItem) {
+	closeSparseItem(itm)
+	delete(cache.items, name)
+	if cache.Policy != nil {
+		cache.Policy.OnRemove(name, itm.Size)
+	}
+}
+
+// item_listener is a goroutine that listens for incoming files on pipe and
+// caches them. pipe is the specific channel created by the Start() call
+// that spawned this goroutine, so a later Start()/Stop() replacing
+// cache.in_pipe doesn't affect it; it exits once pipe is closed.
+func (cache *FileCache) item_listener(pipe chan string) {
 	for {
-		name, closed := <-cache.in_pipe
-		if !closed {
+		name, ok := <-pipe
+		if !ok {
 			return
 		}
-		cache.add_item(name)
+		cache.mu.Lock()
+		if cache.items != nil {
+			cache.add_item(name)
+		}
+		cache.mu.Unlock()
 	}
 }
 
 // Cache will store the file named by 'name' to the cache.
 // This function doesn't return anything as it passes the file onto the
 // incoming pipe; the file will be cached asynchronously. Errors will
-// not be returned. 
+// not be returned.
 func (cache *FileCache) Cache(name string) {
-	if cache.Size() == cache.MaxItems {
+	cache.mu.Lock()
+	if cache.items != nil && len(cache.items) == cache.MaxItems {
 		cache.expire_oldest(true)
 	}
-	cache.in_pipe <- name
+	pipe := cache.in_pipe
+	cache.mu.Unlock()
+	if pipe != nil {
+		// Stop or Start may close pipe once cache.mu is released; a name
+		// sent on the closed pipe is dropped instead of panicking.
+		defer func() { recover() }()
+		pipe <- name
+	}
 }
 
-// CacheNow immediately caches the file named by 'name'.
+// CacheNow immediately caches the file named by 'name'. Concurrent
+// CacheNow calls for the same name coalesce into a single read.
 func (cache *FileCache) CacheNow(name string) (err error) {
-	if cache.Size() == cache.MaxItems {
+	cache.mu.Lock()
+	if cache.items == nil {
+		cache.mu.Unlock()
+		return CacheStopped
+	}
+	if cache.Mode == CacheModePartial {
+		if _, ok := cache.items[name]; ok && !cache.item_expired(name) {
+			cache.mu.Unlock()
+			return nil
+		}
+		if len(cache.items) == cache.MaxItems {
+			cache.expire_oldest(true)
+		}
+		err = cache.add_item(name)
+		cache.mu.Unlock()
+		return
+	}
+	if _, ok := cache.items[name]; ok && !cache.item_expired(name) {
+		cache.mu.Unlock()
+		return nil
+	}
+	if len(cache.items) == cache.MaxItems {
 		cache.expire_oldest(true)
 	}
-	return cache.add_item(name)
+	cache.mu.Unlock()
+
+	_, err = cache.singleflight(name, func() ([]byte, error) {
+		return cache.fetch_and_cache(name)
+	})
+	return
 }
 
-// Start activates the file cache; it will 
+// Start activates the file cache; it will
 func (cache *FileCache) Start() {
+	cache.mu.Lock()
 	if cache.in_pipe != nil {
 		close(cache.in_pipe)
 	}
+	if cache.done != nil {
+		close(cache.done)
+	}
 	cache.items = make(map[string]*cacheItem, 0)
+	if cache.Persistent && cache.Dir != "" {
+		cache.loadIndex()
+	}
 	cache.in_pipe = make(chan string, NewCachePipeSize)
-	go cache.item_listener()
-	go cache.vaccuum()
+	cache.done = make(chan struct{})
+	pipe := cache.in_pipe
+	done := cache.done
+	cache.mu.Unlock()
+
+	go cache.item_listener(pipe)
+	go cache.vaccuum(done)
 }
 
 // expire_oldest is used to expire the oldest item in the cache.
 // The force argument is used to indicate it should remove at least one
 // entry; for example, if a large number of files are cached at once, none
-// may appear older than another.
+// may appear older than another. The caller must hold cache.mu.
 func (cache *FileCache) expire_oldest(force bool) {
+	if cache.Policy != nil {
+		if name := cache.Policy.Victim(); name != "" {
+			cache.remove_item(name)
+		}
+		return
+	}
+
 	oldest := time.Now()
 	oldest_name := ""
 
@@ -348,14 +547,14 @@ func (cache *FileCache) expire_oldest(force bool) {
 		}
 	}
 	if oldest_name != "" {
-		delete(cache.items, oldest_name)
+		cache.remove_item(oldest_name)
 	}
 }
 
 // vaccuum is a background goroutine responsible for cleaning the cache.
-// It runs periodically, every cache.Every seconds. If cache.Every is set
-// to 0, it will not run.
-func (cache *FileCache) vaccuum() {
+// It runs periodically, every cache.Every seconds, until done is closed.
+// If cache.Every is set to 0, it will not run.
+func (cache *FileCache) vaccuum(done chan struct{}) {
 	if cache.Every < 1 {
 		return
 	}
@@ -365,32 +564,46 @@ func (cache *FileCache) vaccuum() {
 		panic(err.Error())
 	}
 	for {
-		<-time.After(time.Duration(dur))
+		select {
+		case <-done:
+			return
+		case <-time.After(dur):
+		}
+
+		cache.mu.Lock()
 		if cache.items == nil {
+			cache.mu.Unlock()
 			return
 		}
 		for name, _ := range cache.items {
 			if cache.item_expired(name) {
-				delete(cache.items, name)
+				cache.remove_item(name)
 			}
 		}
-		for size := cache.Size(); size > cache.MaxItems; size = cache.Size() {
+		for len(cache.items) > cache.MaxItems {
 			cache.expire_oldest(true)
 		}
+		cache.mu.Unlock()
 	}
 }
 
 // Stop turns off the file cache.
 // This closes the concurrent caching mechanism, destroys the cache, and
-// the background scanner that it should stop.
-// If there are any items or cache operations ongoing while Stop() is called,
-// it is undefined how they will behave. 
+// stops the background scanner. It is idempotent and safe to call
+// concurrently with Cache, CacheNow and Start.
 func (cache *FileCache) Stop() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
 	if cache.in_pipe != nil {
 		close(cache.in_pipe)
+		cache.in_pipe = nil
 	}
-	for name, _ := range cache.items {
-		delete(cache.items, name)
+	if cache.done != nil {
+		close(cache.done)
+		cache.done = nil
+	}
+	for name, itm := range cache.items {
+		cache.detach_item(name, itm)
 	}
 	cache.items = nil
 }
@@ -399,11 +612,13 @@ func (cache *FileCache) Stop() {
 // It returns a boolean indicating whether anything was removed, and an error
 // if an error has occurred.
 func (cache *FileCache) Remove(name string) (ok bool, err error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
 	_, ok = cache.items[name]
 	if !ok {
 		return
 	}
-	delete(cache.items, name)
+	cache.remove_item(name)
 	_, valid := cache.items[name]
 	if valid {
 		ok = false
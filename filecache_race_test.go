@@ -0,0 +1,72 @@
+package filecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentAccess hammers a single FileCache from many goroutines
+// performing every mutating and read-only operation at once - Cache,
+// CacheNow, GetItem, ReadFile, Remove, and the Size/FileSize/StoredFiles
+// accessors - while the background vaccuum goroutine is also running.
+// Run with -race to catch data races in the locking guarding cache.items,
+// cache.in_pipe and cache.sfCalls.
+func TestConcurrentAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filecache-race")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const numFiles = 10
+	paths := make([]string, numFiles)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, "file-"+strconv.Itoa(i))
+		if err := ioutil.WriteFile(paths[i], []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache := NewDefaultCache()
+	cache.MaxItems = numFiles / 2
+	cache.ExpireItem = 1
+	cache.Every = 1
+	cache.Start()
+
+	const numWorkers = 50
+	const opsPerWorker = 200
+
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for w := 0; w < numWorkers; w++ {
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < opsPerWorker; i++ {
+				p := paths[(w+i)%numFiles]
+				switch i % 6 {
+				case 0:
+					cache.CacheNow(p)
+				case 1:
+					cache.GetItem(p)
+				case 2:
+					cache.ReadFile(p)
+				case 3:
+					cache.Remove(p)
+				case 4:
+					cache.Cache(p)
+				case 5:
+					cache.Size()
+					cache.FileSize()
+					cache.StoredFiles()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	cache.Stop()
+}
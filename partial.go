@@ -0,0 +1,269 @@
+package filecache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CacheMode selects how FileCache stores cached file content.
+type CacheMode int
+
+const (
+	// CacheModeFull caches whole files in memory, as cacheItem.Content.
+	// This is the default and matches the cache's original behaviour.
+	CacheModeFull CacheMode = iota
+
+	// CacheModePartial caches files as sparse files under SparseDir, with
+	// an in-memory rangeSet tracking which byte intervals are populated.
+	// Use this mode for files larger than MaxSize, or for random-access
+	// workloads where loading a whole file is wasteful. ReadFileAt and
+	// WriteFileRange are the only ways to read items cached this way.
+	CacheModePartial
+)
+
+// UnsupportedCacheMode is returned by operations that require a cache mode
+// other than the one currently configured on FileCache.Mode.
+var UnsupportedCacheMode = errors.New("operation not supported by the current CacheMode")
+
+// errItemEvicted is returned internally by readRangeOnce when the
+// cacheItem it was about to read from was evicted (and its sparse file
+// closed) out from under it. ReadFileAt retries against a freshly cached
+// item when it sees this error rather than surfacing it to the caller.
+var errItemEvicted = errors.New("filecache: item evicted during read")
+
+// sparsePath returns the path of the sparse backing file for name under
+// dir. Names are hashed so that arbitrary file paths, including ones
+// containing path separators, map to a single flat file.
+func sparsePath(dir, name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return filepath.Join(dir, hex.EncodeToString(sum[:]))
+}
+
+// add_partial_item is the CacheModePartial counterpart to add_item: rather
+// than reading the whole file into memory, it opens (or creates) a sparse
+// backing file of the same size and starts the item with an empty
+// rangeSet. Bytes are only read from the underlying file, and written into
+// the sparse file, as they are requested through ReadFileAt. The caller
+// must hold cache.mu.
+func (cache *FileCache) add_partial_item(name string) (err error) {
+	_, ok := cache.items[name]
+	expired := cache.item_expired(name)
+	if ok && !expired {
+		return nil
+	} else if ok {
+		cache.remove_item(name)
+	}
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		return
+	} else if fi.Mode().IsDir() {
+		return ItemIsDirectory
+	}
+
+	path := sparsePath(cache.SparseDir, name)
+	sparse, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	if err = sparse.Truncate(fi.Size()); err != nil {
+		sparse.Close()
+		return
+	}
+
+	itm := new(cacheItem)
+	itm.Size = fi.Size()
+	itm.Modified = fi.ModTime()
+	itm.Lastaccess = time.Now()
+	itm.sparse = sparse
+	itm.ranges = new(rangeSet)
+	cache.items[name] = itm
+	if cache.Policy != nil {
+		cache.Policy.OnAdd(name, itm.Size)
+	}
+	return nil
+}
+
+// fill_range reads [start, end) of name from the underlying filesystem and
+// writes it into itm's sparse file, extending itm.ranges to cover it. The
+// caller must hold itm.mu.
+func (cache *FileCache) fill_range(name string, itm *cacheItem, start, end int64) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	buf := make([]byte, end-start)
+	if _, err := src.ReadAt(buf, start); err != nil && err != io.EOF {
+		return err
+	}
+	if _, err := itm.sparse.WriteAt(buf, start); err != nil {
+		return err
+	}
+	itm.ranges.insert(start, end)
+	return nil
+}
+
+// partial_item returns the cacheItem caching name under CacheModePartial,
+// creating it via CacheNow if it isn't already cached. If the source
+// file's mtime no longer matches what was cached, the stale item (and its
+// sparse file and rangeSet) is dropped first and rebuilt from scratch, so
+// a changed file never serves bytes cached before the change.
+func (cache *FileCache) partial_item(name string) (*cacheItem, error) {
+	cache.mu.RLock()
+	itm, ok := cache.items[name]
+	cache.mu.RUnlock()
+
+	if ok {
+		if fi, err := os.Stat(name); err != nil || !fi.ModTime().Equal(itm.Modified) {
+			cache.mu.Lock()
+			if cur, still := cache.items[name]; still && cur == itm {
+				cache.remove_item(name)
+			}
+			cache.mu.Unlock()
+			ok = false
+		}
+	}
+
+	if !ok {
+		if err := cache.CacheNow(name); err != nil {
+			return nil, err
+		}
+		cache.mu.RLock()
+		itm, ok = cache.items[name]
+		cache.mu.RUnlock()
+		if !ok {
+			// Evicted by another goroutine between CacheNow and this
+			// lookup; ReadFileAt retries.
+			return nil, errItemEvicted
+		}
+	}
+	return itm, nil
+}
+
+// ReadFileAt returns up to n bytes of the cached file name starting at
+// offset off. Intervals already present in the sparse cache file are
+// served directly; missing intervals are read from the underlying file and
+// copied into the sparse file before being returned, so repeated reads of
+// the same range are satisfied from cache. If name has changed on disk
+// since it was cached, the cached range set is invalidated and rebuilt.
+// FileCache.Mode must be CacheModePartial.
+//
+// Ranges that are already fully cached are served under itm's read lock,
+// so concurrent reads of cached data aren't serialized against each
+// other; the write lock is only taken when a gap actually needs filling.
+// If the item is evicted (e.g. by MaxItems pressure from another
+// goroutine) while this call is in flight, it transparently retries
+// against a freshly cached item rather than returning a stale-handle
+// error.
+func (cache *FileCache) ReadFileAt(name string, off, n int64) ([]byte, error) {
+	if cache.Mode != CacheModePartial {
+		return nil, UnsupportedCacheMode
+	}
+
+	for {
+		buf, err := cache.readRangeOnce(name, off, n)
+		if err == errItemEvicted {
+			continue
+		}
+		return buf, err
+	}
+}
+
+// readRangeOnce is the single-attempt body of ReadFileAt. It returns
+// errItemEvicted if itm was evicted and its sparse file closed while this
+// call held it, rather than reading or writing the now-closed file.
+func (cache *FileCache) readRangeOnce(name string, off, n int64) ([]byte, error) {
+	itm, err := cache.partial_item(name)
+	if err != nil {
+		return nil, err
+	}
+
+	itm.mu.RLock()
+	if itm.closed {
+		itm.mu.RUnlock()
+		return nil, errItemEvicted
+	}
+	end := off + n
+	if end > itm.Size {
+		end = itm.Size
+	}
+	if end <= off {
+		itm.mu.RUnlock()
+		return []byte{}, nil
+	}
+	if len(itm.ranges.missing(off, end)) == 0 {
+		buf := make([]byte, end-off)
+		_, err := itm.sparse.ReadAt(buf, off)
+		itm.mu.RUnlock()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		itm.mu.Lock()
+		if !itm.closed {
+			itm.Lastaccess = time.Now()
+		}
+		itm.mu.Unlock()
+		return buf, nil
+	}
+	itm.mu.RUnlock()
+
+	itm.mu.Lock()
+	defer itm.mu.Unlock()
+	if itm.closed {
+		return nil, errItemEvicted
+	}
+
+	for _, gap := range itm.ranges.missing(off, end) {
+		if err := cache.fill_range(name, itm, gap.Start, gap.End); err != nil {
+			return nil, err
+		}
+	}
+
+	buf := make([]byte, end-off)
+	if _, err := itm.sparse.ReadAt(buf, off); err != nil && err != io.EOF {
+		return nil, err
+	}
+	itm.Lastaccess = time.Now()
+	return buf, nil
+}
+
+// WriteFileRange writes n bytes of the cached file name starting at offset
+// off to w. It is the streaming counterpart to ReadFileAt.
+func (cache *FileCache) WriteFileRange(w io.Writer, name string, off, n int64) error {
+	buf, err := cache.ReadFileAt(name, off, n)
+	if err != nil {
+		return err
+	}
+	written, err := w.Write(buf)
+	if err != nil {
+		return err
+	} else if written != len(buf) {
+		return WriteIncomplete
+	}
+	return nil
+}
+
+// closeSparseItem closes and removes itm's sparse backing file, if any,
+// and marks itm as closed. It is a no-op for items cached under
+// CacheModeFull. Closing under itm.mu means a goroutine already inside
+// ReadFileAt with this itm either finishes its read before this runs, or
+// observes itm.closed and retries against a freshly cached item, rather
+// than racing the close and reading or writing a dangling file handle.
+func closeSparseItem(itm *cacheItem) {
+	itm.mu.Lock()
+	defer itm.mu.Unlock()
+	if itm.sparse == nil {
+		return
+	}
+	itm.closed = true
+	path := itm.sparse.Name()
+	itm.sparse.Close()
+	os.Remove(path)
+}
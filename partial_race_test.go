@@ -0,0 +1,89 @@
+package filecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestReadFileAtSurvivesEviction reproduces the scenario from a reported
+// race: one goroutine repeatedly reads a CacheModePartial item via
+// ReadFileAt while another goroutine forces MaxItems-driven eviction by
+// caching other names. Before ReadFileAt retried on eviction instead of
+// touching a closed sparse file, this produced "file already closed"
+// errors from ReadAt within a couple of seconds. Run with -race.
+func TestReadFileAtSurvivesEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filecache-partial-race")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sparseDir := filepath.Join(dir, "sparse")
+	if err := os.Mkdir(sparseDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	const numFiles = 5
+	paths := make([]string, numFiles)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, "file-"+strconv.Itoa(i))
+		if err := ioutil.WriteFile(paths[i], []byte("0123456789"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache := NewDefaultCache()
+	cache.Mode = CacheModePartial
+	cache.SparseDir = sparseDir
+	cache.MaxItems = 1
+	cache.Start()
+	defer cache.Stop()
+
+	const duration = 500 * time.Millisecond
+	stop := make(chan struct{})
+	time.AfterFunc(duration, func() { close(stop) })
+
+	var wg sync.WaitGroup
+	var readErrs int32
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := cache.ReadFileAt(paths[0], 0, 5); err != nil {
+				atomic.AddInt32(&readErrs, 1)
+			}
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		i := 1
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			cache.CacheNow(paths[i%numFiles])
+			i++
+		}
+	}()
+
+	wg.Wait()
+
+	if readErrs != 0 {
+		t.Fatalf("ReadFileAt returned %d errors under concurrent eviction, want 0", readErrs)
+	}
+}
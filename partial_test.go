@@ -0,0 +1,57 @@
+package filecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCacheNowPartialSkipsEvictionWhenAlreadyCached covers CacheModePartial's
+// branch of CacheNow, which is meant to mirror the CacheModeFull branch
+// just below it: a redundant CacheNow on an item that's already cached and
+// unexpired must be a no-op, not trigger eviction of an unrelated entry.
+func TestCacheNowPartialSkipsEvictionWhenAlreadyCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filecache-partial-cachenow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sparseDir := filepath.Join(dir, "sparse")
+	if err := os.Mkdir(sparseDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "b.txt")
+	if err := ioutil.WriteFile(a, []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(b, []byte("bbbb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewDefaultCache()
+	cache.Mode = CacheModePartial
+	cache.SparseDir = sparseDir
+	cache.MaxItems = 2
+	cache.Start()
+	defer cache.Stop()
+
+	if err := cache.CacheNow(a); err != nil {
+		t.Fatalf("CacheNow(a): %v", err)
+	}
+	if err := cache.CacheNow(b); err != nil {
+		t.Fatalf("CacheNow(b): %v", err)
+	}
+	if !cache.InCache(a) || !cache.InCache(b) {
+		t.Fatalf("expected both cached before redundant CacheNow: a=%v b=%v", cache.InCache(a), cache.InCache(b))
+	}
+
+	if err := cache.CacheNow(b); err != nil {
+		t.Fatalf("redundant CacheNow(b): %v", err)
+	}
+	if !cache.InCache(a) {
+		t.Fatalf("redundant CacheNow(b) evicted unrelated a, want a to remain cached")
+	}
+}
@@ -0,0 +1,141 @@
+package filecache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// persistedEntry is the on-disk representation of one cacheItem, used to
+// rehydrate FileCache.items across restarts when Persistent is true.
+type persistedEntry struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	Modified   time.Time `json:"modified"`
+	Lastaccess time.Time `json:"lastaccess"`
+	SHA256     string    `json:"sha256"`
+	BlobPath   string    `json:"blob_path"`
+}
+
+// indexPath returns the path of the persistent index file under cache.Dir.
+func (cache *FileCache) indexPath() string {
+	return filepath.Join(cache.Dir, "index.json")
+}
+
+// blobPath returns the content-addressed path under dir that stores a blob
+// with the given SHA-256 sum.
+func blobPath(dir string, sum [32]byte) string {
+	hexSum := hex.EncodeToString(sum[:])
+	return filepath.Join(dir, "blobs", hexSum[:2], hexSum)
+}
+
+// loadIndex reads the persistent index from cache.Dir and rehydrates
+// cache.items with lazily-loaded entries, registering each with the
+// active Policy so it remains eligible for eviction. An entry whose
+// source file no longer exists, or whose mtime no longer matches the
+// indexed mtime, is dropped along with its blob, since its cached content
+// is now stale. The caller must hold cache.mu.
+func (cache *FileCache) loadIndex() error {
+	raw, err := ioutil.ReadFile(cache.indexPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var entries []persistedEntry
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		fi, err := os.Stat(e.Name)
+		if err != nil || !fi.ModTime().Equal(e.Modified) {
+			os.Remove(e.BlobPath)
+			continue
+		}
+		itm := new(cacheItem)
+		itm.Size = e.Size
+		itm.Modified = e.Modified
+		itm.Lastaccess = e.Lastaccess
+		itm.sha256 = e.SHA256
+		itm.blobPath = e.BlobPath
+		cache.items[e.Name] = itm
+		if cache.Policy != nil {
+			cache.Policy.OnAdd(e.Name, itm.Size)
+		}
+	}
+	return nil
+}
+
+// saveIndex writes the current persisted items to the index file under
+// cache.Dir, atomically. Items that haven't been persisted yet (no
+// blobPath, e.g. CacheModePartial items) are skipped. The caller must hold
+// cache.mu.
+func (cache *FileCache) saveIndex() error {
+	entries := make([]persistedEntry, 0, len(cache.items))
+	for name, itm := range cache.items {
+		if itm.blobPath == "" {
+			continue
+		}
+		entries = append(entries, persistedEntry{
+			Name:       name,
+			Size:       itm.Size,
+			Modified:   itm.Modified,
+			Lastaccess: itm.Lastaccess,
+			SHA256:     itm.sha256,
+			BlobPath:   itm.blobPath,
+		})
+	}
+
+	raw, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(cache.indexPath(), raw)
+}
+
+// persist_item writes itm's content to a content-addressed blob file under
+// cache.Dir and records its location on itm, then rewrites the index so
+// the item survives a restart. The caller must hold cache.mu.
+func (cache *FileCache) persist_item(name string, itm *cacheItem) error {
+	sum := sha256.Sum256(itm.Content)
+	path := blobPath(cache.Dir, sum)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := writeAtomic(path, itm.Content); err != nil {
+			return err
+		}
+	}
+	itm.sha256 = hex.EncodeToString(sum[:])
+	itm.blobPath = path
+	return cache.saveIndex()
+}
+
+// loadContent returns itm.Content, reading it from itm.blobPath first if it
+// hasn't been loaded into memory yet. This lets Start() rehydrate an index
+// without paying the cost of reading every blob up front.
+func loadContent(itm *cacheItem) ([]byte, error) {
+	itm.mu.RLock()
+	if itm.Content != nil || itm.blobPath == "" {
+		content := itm.Content
+		itm.mu.RUnlock()
+		return content, nil
+	}
+	itm.mu.RUnlock()
+
+	itm.mu.Lock()
+	defer itm.mu.Unlock()
+	if itm.Content != nil {
+		return itm.Content, nil
+	}
+	data, err := ioutil.ReadFile(itm.blobPath)
+	if err != nil {
+		return nil, err
+	}
+	itm.Content = data
+	return data, nil
+}
@@ -0,0 +1,145 @@
+package filecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestPersistentCacheRehydratesAndStaysEvictable starts a Persistent
+// cache, caches a file, stops it, and starts a fresh FileCache pointed at
+// the same Dir - the scenario the 723e879 fix had to patch after the
+// fact, and which was never covered by a test itself. It checks that the
+// item survives the restart, that Stop() didn't erase Dir's index and
+// blobs, and that the rehydrated item is registered with the Policy so
+// it's evictable like any other item.
+func TestPersistentCacheRehydratesAndStaysEvictable(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "filecache-persist-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	storeDir, err := ioutil.TempDir("", "filecache-persist-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+
+	path := filepath.Join(srcDir, "cached.txt")
+	want := []byte("persist me across a restart")
+	if err := ioutil.WriteFile(path, want, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache1 := NewDefaultCache()
+	cache1.Persistent = true
+	cache1.Dir = storeDir
+	cache1.Start()
+
+	if err := cache1.CacheNow(path); err != nil {
+		t.Fatalf("CacheNow: %v", err)
+	}
+	if content, ok := cache1.GetItem(path); !ok || string(content) != string(want) {
+		t.Fatalf("GetItem before Stop = (%q, %v), want (%q, true)", content, ok, want)
+	}
+
+	cache1.Stop()
+
+	// Stop() must not have wiped the persisted index or blob.
+	raw, err := ioutil.ReadFile(filepath.Join(storeDir, "index.json"))
+	if err != nil {
+		t.Fatalf("reading index.json after Stop: %v", err)
+	}
+	if string(raw) == "[]" || string(raw) == "null" {
+		t.Fatalf("index.json after Stop = %q, want a populated index", raw)
+	}
+
+	cache2 := NewDefaultCache()
+	cache2.Persistent = true
+	cache2.Dir = storeDir
+	cache2.Start()
+	defer cache2.Stop()
+
+	if !cache2.InCache(path) {
+		t.Fatalf("InCache(%q) after rehydrate = false, want true", path)
+	}
+	content, ok := cache2.GetItem(path)
+	if !ok || string(content) != string(want) {
+		t.Fatalf("GetItem after rehydrate = (%q, %v), want (%q, true)", content, ok, want)
+	}
+
+	if v := cache2.Policy.Victim(); v != path {
+		t.Fatalf("Policy.Victim() after rehydrate = %q, want %q - rehydrated item isn't tracked by Policy", v, path)
+	}
+
+	// A rehydrated item must actually be evictable: force MaxItems
+	// pressure with a second file and confirm the first is dropped.
+	other := filepath.Join(srcDir, "other.txt")
+	if err := ioutil.WriteFile(other, []byte("another file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cache2.MaxItems = 1
+	if err := cache2.CacheNow(other); err != nil {
+		t.Fatalf("CacheNow(other): %v", err)
+	}
+	if cache2.InCache(path) {
+		t.Fatalf("InCache(%q) after MaxItems eviction = true, want false", path)
+	}
+}
+
+// TestEvictingSharedBlobKeepsOtherItemReadable covers a case specific to
+// content-addressed persistence: two different names with byte-identical
+// content share one blobPath. Evicting one must not delete that blob out
+// from under the other, or the survivor reads fine from memory but fails
+// to rehydrate after the next restart.
+func TestEvictingSharedBlobKeepsOtherItemReadable(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "filecache-persist-shared-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	storeDir, err := ioutil.TempDir("", "filecache-persist-shared-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+
+	a := filepath.Join(srcDir, "a.txt")
+	b := filepath.Join(srcDir, "b.txt")
+	content := []byte("identical content shared by a and b")
+	if err := ioutil.WriteFile(a, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(b, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewDefaultCache()
+	cache.Persistent = true
+	cache.Dir = storeDir
+	cache.Start()
+
+	if err := cache.CacheNow(a); err != nil {
+		t.Fatalf("CacheNow(a): %v", err)
+	}
+	if err := cache.CacheNow(b); err != nil {
+		t.Fatalf("CacheNow(b): %v", err)
+	}
+	cache.mu.Lock()
+	cache.expire_oldest(true) // evicts a, the LRU entry
+	cache.mu.Unlock()
+
+	cache.Stop()
+
+	fresh := NewDefaultCache()
+	fresh.Persistent = true
+	fresh.Dir = storeDir
+	fresh.Start()
+	defer fresh.Stop()
+
+	got, ok := fresh.GetItem(b)
+	if !ok || string(got) != string(content) {
+		t.Fatalf("GetItem(b) after evicting a = (%q, %v), want (%q, true) - b's blob was shared with, and removed alongside, a", got, ok, content)
+	}
+}
@@ -0,0 +1,297 @@
+package filecache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// EvictionPolicy decides which cache entries to evict and tracks basic
+// hit/miss/eviction statistics. Implementations must be safe for
+// concurrent use; FileCache calls into them from the cache's own
+// goroutines (item_listener, vaccuum) as well as from caller goroutines.
+type EvictionPolicy interface {
+	// OnAccess is called whenever GetItem, GetItemString or WriteItem
+	// looks name up, whether or not it is present. ReadFile,
+	// ReadFileString and WriteFile reach it only on a cache hit, and
+	// ReadFileAt does not call it.
+	OnAccess(name string)
+
+	// OnAdd is called whenever name is added to the cache, with its size
+	// in bytes.
+	OnAdd(name string, size int64)
+
+	// OnRemove is called whenever name is removed from the cache, whether
+	// by eviction, expiry, or an explicit Remove.
+	OnRemove(name string, size int64)
+
+	// Victim returns the name of the entry that should be evicted next,
+	// or "" if the policy has nothing to evict.
+	Victim() string
+
+	// Stats returns a snapshot of the policy's counters.
+	Stats() Stats
+}
+
+// Stats holds cache hit/miss/eviction counters as tracked by an
+// EvictionPolicy. Evictions and BytesEvicted count every OnRemove call,
+// not only ones the policy itself chose via Victim.
+type Stats struct {
+	Hits         int64
+	Misses       int64
+	Evictions    int64
+	BytesEvicted int64
+}
+
+// Stats returns a snapshot of cache-wide hit/miss/eviction counters as
+// tracked by the active Policy. It returns a zero Stats if no Policy is
+// set.
+func (cache *FileCache) Stats() Stats {
+	if cache.Policy == nil {
+		return Stats{}
+	}
+	return cache.Policy.Stats()
+}
+
+// LRUPolicy evicts the least recently used entry first, using a doubly
+// linked list for O(1) touch and evict.
+type LRUPolicy struct {
+	mu    sync.Mutex
+	ll    *list.List
+	elems map[string]*list.Element
+	stats Stats
+}
+
+// NewLRUPolicy returns an empty LRUPolicy.
+func NewLRUPolicy() *LRUPolicy {
+	return &LRUPolicy{
+		ll:    list.New(),
+		elems: make(map[string]*list.Element),
+	}
+}
+
+func (p *LRUPolicy) OnAccess(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.elems[name]; ok {
+		p.ll.MoveToFront(e)
+		p.stats.Hits++
+	} else {
+		p.stats.Misses++
+	}
+}
+
+func (p *LRUPolicy) OnAdd(name string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.elems[name]; ok {
+		p.ll.MoveToFront(e)
+		return
+	}
+	p.elems[name] = p.ll.PushFront(name)
+}
+
+func (p *LRUPolicy) OnRemove(name string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.elems[name]; ok {
+		p.ll.Remove(e)
+		delete(p.elems, name)
+	}
+	p.stats.Evictions++
+	p.stats.BytesEvicted += size
+}
+
+func (p *LRUPolicy) Victim() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.ll.Back()
+	if e == nil {
+		return ""
+	}
+	return e.Value.(string)
+}
+
+func (p *LRUPolicy) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// LFUPolicy evicts the least frequently accessed entry first, using
+// frequency buckets so that touch and evict are both O(1) amortised.
+type LFUPolicy struct {
+	mu      sync.Mutex
+	freq    map[string]int64
+	buckets map[int64]map[string]struct{}
+	minFreq int64
+	stats   Stats
+}
+
+// NewLFUPolicy returns an empty LFUPolicy.
+func NewLFUPolicy() *LFUPolicy {
+	return &LFUPolicy{
+		freq:    make(map[string]int64),
+		buckets: make(map[int64]map[string]struct{}),
+	}
+}
+
+// touch bumps name's frequency by one bucket. The caller must hold p.mu.
+func (p *LFUPolicy) touch(name string) {
+	f := p.freq[name]
+	if b, ok := p.buckets[f]; ok {
+		delete(b, name)
+		if len(b) == 0 {
+			delete(p.buckets, f)
+			if p.minFreq == f {
+				p.minFreq = f + 1
+			}
+		}
+	}
+	f++
+	p.freq[name] = f
+	if p.buckets[f] == nil {
+		p.buckets[f] = make(map[string]struct{})
+	}
+	p.buckets[f][name] = struct{}{}
+}
+
+func (p *LFUPolicy) OnAccess(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.freq[name]; ok {
+		p.touch(name)
+		p.stats.Hits++
+	} else {
+		p.stats.Misses++
+	}
+}
+
+func (p *LFUPolicy) OnAdd(name string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.freq[name]; ok {
+		return
+	}
+	p.freq[name] = 1
+	if p.buckets[1] == nil {
+		p.buckets[1] = make(map[string]struct{})
+	}
+	p.buckets[1][name] = struct{}{}
+	p.minFreq = 1
+}
+
+func (p *LFUPolicy) OnRemove(name string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if f, ok := p.freq[name]; ok {
+		delete(p.buckets[f], name)
+		if len(p.buckets[f]) == 0 {
+			delete(p.buckets, f)
+		}
+		delete(p.freq, name)
+	}
+	p.stats.Evictions++
+	p.stats.BytesEvicted += size
+}
+
+func (p *LFUPolicy) Victim() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b, ok := p.buckets[p.minFreq]
+	if !ok || len(b) == 0 {
+		b = nil
+		for f, bucket := range p.buckets {
+			if len(bucket) == 0 {
+				continue
+			}
+			if b == nil || f < p.minFreq {
+				p.minFreq = f
+				b = bucket
+			}
+		}
+	}
+	for name := range b {
+		return name
+	}
+	return ""
+}
+
+func (p *LFUPolicy) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// sizeWeightedEntry tracks the bookkeeping SizeWeightedPolicy needs per
+// cached name.
+type sizeWeightedEntry struct {
+	size       int64
+	lastaccess time.Time
+}
+
+// SizeWeightedPolicy evicts large, stale entries before small, fresh
+// ones, preferring to reclaim space quickly over strict recency.
+type SizeWeightedPolicy struct {
+	mu    sync.Mutex
+	items map[string]sizeWeightedEntry
+	stats Stats
+}
+
+// NewSizeWeightedPolicy returns an empty SizeWeightedPolicy.
+func NewSizeWeightedPolicy() *SizeWeightedPolicy {
+	return &SizeWeightedPolicy{items: make(map[string]sizeWeightedEntry)}
+}
+
+func (p *SizeWeightedPolicy) OnAccess(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.items[name]; ok {
+		e.lastaccess = time.Now()
+		p.items[name] = e
+		p.stats.Hits++
+	} else {
+		p.stats.Misses++
+	}
+}
+
+func (p *SizeWeightedPolicy) OnAdd(name string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.items[name] = sizeWeightedEntry{size: size, lastaccess: time.Now()}
+}
+
+func (p *SizeWeightedPolicy) OnRemove(name string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.items, name)
+	p.stats.Evictions++
+	p.stats.BytesEvicted += size
+}
+
+// Victim returns the name with the largest size * staleness score, so
+// large files that haven't been touched in a while are evicted before
+// small, frequently accessed ones.
+func (p *SizeWeightedPolicy) Victim() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var victim string
+	var best float64
+	now := time.Now()
+	for name, e := range p.items {
+		score := float64(e.size) * now.Sub(e.lastaccess).Seconds()
+		if victim == "" || score > best {
+			victim = name
+			best = score
+		}
+	}
+	return victim
+}
+
+func (p *SizeWeightedPolicy) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
@@ -0,0 +1,98 @@
+package filecache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUPolicyVictim(t *testing.T) {
+	p := NewLRUPolicy()
+	p.OnAdd("a", 1)
+	p.OnAdd("b", 1)
+	p.OnAdd("c", 1)
+
+	if v := p.Victim(); v != "a" {
+		t.Fatalf("Victim() = %q, want %q", v, "a")
+	}
+
+	p.OnAccess("a")
+	if v := p.Victim(); v != "b" {
+		t.Fatalf("Victim() after touching a = %q, want %q", v, "b")
+	}
+
+	p.OnRemove("b", 1)
+	if v := p.Victim(); v != "c" {
+		t.Fatalf("Victim() after removing b = %q, want %q", v, "c")
+	}
+
+	p.OnRemove("c", 1)
+	p.OnRemove("a", 1)
+	if v := p.Victim(); v != "" {
+		t.Fatalf("Victim() on empty policy = %q, want \"\"", v)
+	}
+}
+
+func TestLFUPolicyVictim(t *testing.T) {
+	p := NewLFUPolicy()
+	p.OnAdd("a", 1)
+	p.OnAdd("b", 1)
+	p.OnAdd("c", 1)
+
+	// All three start at frequency 1; b and c are accessed, bumping them
+	// to frequency 2, so a is the least frequently used.
+	p.OnAccess("b")
+	p.OnAccess("c")
+	if v := p.Victim(); v != "a" {
+		t.Fatalf("Victim() = %q, want %q", v, "a")
+	}
+
+	p.OnRemove("a", 1)
+	// b and c are both at frequency 2; bump c again so b becomes the
+	// least frequently used of the two.
+	p.OnAccess("c")
+	if v := p.Victim(); v != "b" {
+		t.Fatalf("Victim() after removing a = %q, want %q", v, "b")
+	}
+
+	p.OnRemove("b", 1)
+	p.OnRemove("c", 1)
+	if v := p.Victim(); v != "" {
+		t.Fatalf("Victim() on empty policy = %q, want \"\"", v)
+	}
+}
+
+func TestSizeWeightedPolicyVictim(t *testing.T) {
+	p := NewSizeWeightedPolicy()
+
+	p.OnAdd("small-stale", 10)
+	p.OnAdd("large-fresh", 1000)
+	p.OnAdd("large-stale", 1000)
+
+	// Age small-stale and large-stale by backdating their lastaccess, so
+	// their size*staleness score is deterministic relative to large-fresh
+	// (just added, so its score is ~0).
+	p.mu.Lock()
+	e := p.items["small-stale"]
+	e.lastaccess = time.Now().Add(-time.Hour)
+	p.items["small-stale"] = e
+
+	e = p.items["large-stale"]
+	e.lastaccess = time.Now().Add(-time.Hour)
+	p.items["large-stale"] = e
+	p.mu.Unlock()
+
+	if v := p.Victim(); v != "large-stale" {
+		t.Fatalf("Victim() = %q, want %q", v, "large-stale")
+	}
+
+	p.OnRemove("large-stale", 1000)
+	if v := p.Victim(); v != "small-stale" {
+		t.Fatalf("Victim() after removing large-stale = %q, want %q", v, "small-stale")
+	}
+
+	p.OnRemove("small-stale", 10)
+	p.OnRemove("large-fresh", 1000)
+	if v := p.Victim(); v != "" {
+		t.Fatalf("Victim() on empty policy = %q, want \"\"", v)
+	}
+}
@@ -0,0 +1,71 @@
+package filecache
+
+import "sort"
+
+// byteRange represents a half-open interval [Start, End) of a file that has
+// been populated in a sparse cache file.
+type byteRange struct {
+	Start, End int64
+}
+
+// rangeSet tracks the byte intervals of a file that are currently present
+// in a sparse cache file. Intervals are kept sorted and merged on insert so
+// that overlapping or adjacent ranges never fragment the set.
+type rangeSet struct {
+	ranges []byteRange
+}
+
+// insert records [start, end) as populated, merging it with any ranges it
+// overlaps or touches.
+func (rs *rangeSet) insert(start, end int64) {
+	if start >= end {
+		return
+	}
+
+	i := sort.Search(len(rs.ranges), func(i int) bool {
+		return rs.ranges[i].Start >= start
+	})
+
+	merged := byteRange{Start: start, End: end}
+	lo, hi := i, i
+	if lo > 0 && rs.ranges[lo-1].End >= start {
+		lo--
+		merged.Start = rs.ranges[lo].Start
+	}
+	for hi < len(rs.ranges) && rs.ranges[hi].Start <= merged.End {
+		if rs.ranges[hi].End > merged.End {
+			merged.End = rs.ranges[hi].End
+		}
+		hi++
+	}
+
+	next := make([]byteRange, 0, len(rs.ranges)-(hi-lo)+1)
+	next = append(next, rs.ranges[:lo]...)
+	next = append(next, merged)
+	next = append(next, rs.ranges[hi:]...)
+	rs.ranges = next
+}
+
+// missing returns the sub-intervals of [start, end) that are not yet
+// covered by the set, in order.
+func (rs *rangeSet) missing(start, end int64) []byteRange {
+	var gaps []byteRange
+	cursor := start
+
+	i := sort.Search(len(rs.ranges), func(i int) bool {
+		return rs.ranges[i].End > start
+	})
+	for ; i < len(rs.ranges) && rs.ranges[i].Start < end; i++ {
+		r := rs.ranges[i]
+		if r.Start > cursor {
+			gaps = append(gaps, byteRange{Start: cursor, End: r.Start})
+		}
+		if r.End > cursor {
+			cursor = r.End
+		}
+	}
+	if cursor < end {
+		gaps = append(gaps, byteRange{Start: cursor, End: end})
+	}
+	return gaps
+}
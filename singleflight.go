@@ -0,0 +1,82 @@
+package filecache
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// sfCall tracks a single in-flight fetch-and-cache of one file, shared by
+// every caller that misses the cache for the same name concurrently.
+type sfCall struct {
+	wg      sync.WaitGroup
+	content []byte
+	err     error
+}
+
+// singleflight runs fn for name, or waits for and returns the result of an
+// identical call already in flight. This keeps concurrent cache misses for
+// the same file from each reading it from disk independently.
+func (cache *FileCache) singleflight(name string, fn func() ([]byte, error)) ([]byte, error) {
+	cache.sfMu.Lock()
+	if cache.sfCalls == nil {
+		cache.sfCalls = make(map[string]*sfCall)
+	}
+	if c, ok := cache.sfCalls[name]; ok {
+		cache.sfMu.Unlock()
+		c.wg.Wait()
+		return c.content, c.err
+	}
+
+	c := new(sfCall)
+	c.wg.Add(1)
+	cache.sfCalls[name] = c
+	cache.sfMu.Unlock()
+
+	c.content, c.err = fn()
+	c.wg.Done()
+
+	cache.sfMu.Lock()
+	delete(cache.sfCalls, name)
+	cache.sfMu.Unlock()
+
+	return c.content, c.err
+}
+
+// openFile opens name for reading in fetch_and_cache. It's a package
+// variable, rather than a direct call to os.Open, so tests can wrap it to
+// count or inspect the underlying filesystem opens that singleflight
+// coalesces.
+var openFile = os.Open
+
+// fetch_and_cache reads name from the filesystem and, if it fits within
+// MaxSize, stores it in the cache. It is the function run under
+// singleflight by ReadFile, ReadFileString, WriteFile and CacheNow so that
+// concurrent misses for the same name share one read.
+func (cache *FileCache) fetch_and_cache(name string) ([]byte, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	} else if fi.Mode().IsDir() {
+		return nil, ItemIsDirectory
+	}
+
+	f, err := openFile(name)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.Size() <= cache.MaxSize {
+		cache.mu.Lock()
+		if cache.items != nil {
+			cache.store_item(name, content, fi)
+		}
+		cache.mu.Unlock()
+	}
+	return content, nil
+}
@@ -0,0 +1,62 @@
+package filecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestReadFileSingleflightCoalescesMisses hammers ReadFile for the same
+// uncached file from many goroutines at once and asserts that only one of
+// them actually opens it - the rest should be served the in-flight call's
+// result via singleflight.
+func TestReadFileSingleflightCoalescesMisses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filecache-singleflight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "shared.txt")
+	want := []byte("hello, singleflight")
+	if err := ioutil.WriteFile(path, want, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	orig := openFile
+	var opens int32
+	openFile = func(name string) (*os.File, error) {
+		atomic.AddInt32(&opens, 1)
+		return orig(name)
+	}
+	defer func() { openFile = orig }()
+
+	cache := NewDefaultCache()
+	cache.Start()
+	defer cache.Stop()
+
+	const numCallers = 1000
+	var wg sync.WaitGroup
+	wg.Add(numCallers)
+	for i := 0; i < numCallers; i++ {
+		go func() {
+			defer wg.Done()
+			content, err := cache.ReadFile(path)
+			if err != nil && err != ItemNotInCache {
+				t.Errorf("ReadFile: %v", err)
+				return
+			}
+			if string(content) != string(want) {
+				t.Errorf("ReadFile content = %q, want %q", content, want)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&opens); got != 1 {
+		t.Fatalf("underlying file opened %d times, want exactly 1", got)
+	}
+}